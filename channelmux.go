@@ -0,0 +1,208 @@
+package websocket
+
+import (
+	"encoding/base64"
+	"io"
+	"sync"
+)
+
+// channel.k8s.io 系のサブプロトコル名
+const (
+	ProtocolChannel       = "channel.k8s.io"
+	ProtocolBase64Channel = "base64.channel.k8s.io"
+)
+
+// ChannelMuxOptions NewChannelMux の挙動を設定するオプション
+type ChannelMuxOptions struct {
+	// Base64 true のとき base64.channel.k8s.io 形式 (テキストフレームの先頭バイトが
+	// ASCII 数字のチャンネル番号、残りが base64) で多重化する。
+	// false のときは channel.k8s.io 形式 (バイナリフレームの先頭バイトがチャンネル番号) を使う
+	Base64 bool
+	// DropUnread true のとき、読まれていないペイロードがチャンネルごとに dropUnreadQueueCap 個
+	// 溜まった後に届いたデータを捨てる。
+	// false のときは読み手が Read を呼ぶまで上限なくキューに溜める (受信側はブロックしない)
+	DropUnread bool
+}
+
+// Channels ws.Subprotocol() の結果に応じて channel.k8s.io / base64.channel.k8s.io
+// 形式で n 本の独立したストリームに多重化する
+func (ws *WebSocket) Channels(n int) []io.ReadWriteCloser {
+	return NewChannelMux(ws, n, &ChannelMuxOptions{Base64: ws.Subprotocol() == ProtocolBase64Channel})
+}
+
+// NewChannelMux 1 本の WebSocket 接続を n 本の独立した io.ReadWriteCloser に多重化する。
+// channel.k8s.io / base64.channel.k8s.io と同じ要領で、フレームの先頭にチャンネル番号を
+// 乗せることで多重化する。いずれかのチャンネルを Close すると、そのチャンネル番号宛てに
+// 空フレームが送られ、相手側はそのチャンネルの Read で io.EOF を受け取る。
+// ws.Subscribe の登録が完了してから返るので、戻り値を受け取った時点で相手からの
+// フレームを取りこぼすことはない。
+func NewChannelMux(ws *WebSocket, n int, opts *ChannelMuxOptions) []io.ReadWriteCloser {
+	if opts == nil {
+		opts = &ChannelMuxOptions{}
+	}
+	mux := &channelMux{
+		ws:       ws,
+		opts:     *opts,
+		channels: make([]*muxChannel, n),
+	}
+	ret := make([]io.ReadWriteCloser, n)
+	for i := 0; i < n; i++ {
+		c := &muxChannel{idx: byte(i), mux: mux}
+		c.cond = sync.NewCond(&c.mu)
+		mux.channels[i] = c
+		ret[i] = c
+	}
+	subscribed := make(chan struct{})
+	go mux.demux(subscribed)
+	<-subscribed
+	return ret
+}
+
+// channelMux NewChannelMux が作る多重化の内部状態
+type channelMux struct {
+	ws       *WebSocket
+	opts     ChannelMuxOptions
+	channels []*muxChannel
+}
+
+// demux はこの WebSocket を購読し、届いたフレームをチャンネル番号に応じて各 muxChannel へ
+// 配送する。ws.Subscribe は内部で ws.subscribes に登録してからコールバックを呼ぶので、
+// subscribed を閉じた時点で登録は完了している
+func (m *channelMux) demux(subscribed chan<- struct{}) {
+	defer func() {
+		for _, c := range m.channels {
+			c.closeChannel()
+		}
+	}()
+	m.ws.Subscribe(func(ch <-chan Packet) {
+		close(subscribed)
+		for pkt := range ch {
+			idx, data, ok := m.decode(&pkt)
+			if !ok || int(idx) >= len(m.channels) {
+				continue
+			}
+			m.channels[idx].deliver(data, m.opts.DropUnread)
+		}
+	})
+}
+
+func (m *channelMux) decode(pkt *Packet) (byte, []byte, bool) {
+	if m.opts.Base64 {
+		if pkt.Opcode != OpcodeText || len(pkt.Data) < 1 {
+			return 0, nil, false
+		}
+		idx := pkt.Data[0]
+		if idx < '0' || idx > '9' {
+			return 0, nil, false
+		}
+		data, err := base64.StdEncoding.DecodeString(string(pkt.Data[1:]))
+		if err != nil {
+			return 0, nil, false
+		}
+		return idx - '0', data, true
+	}
+	if pkt.Opcode != OpcodeBinary || len(pkt.Data) < 1 {
+		return 0, nil, false
+	}
+	return pkt.Data[0], pkt.Data[1:], true
+}
+
+func (m *channelMux) sendFrame(idx byte, data []byte) error {
+	if m.opts.Base64 {
+		payload := append([]byte{'0' + idx}, []byte(base64.StdEncoding.EncodeToString(data))...)
+		return m.ws.SendText(string(payload))
+	}
+	frame := make([]byte, len(data)+1)
+	frame[0] = idx
+	copy(frame[1:], data)
+	return m.ws.SendBinary(frame)
+}
+
+// dropUnreadQueueCap DropUnread が有効なチャンネルについて、読み手が追いつくまで
+// バッファしておくペイロードの最大個数。これを超えた分は捨てる
+const dropUnreadQueueCap = 16
+
+// muxChannel channelMux が提供する 1 本のストリーム。
+// 自分専用の mu/cond とキューを持つため、他のチャンネルの読み手が詰まっていても
+// このチャンネルの配送はブロックせず (DropUnread のときは上限を超えた分を捨てる)、
+// demux ゴルーチンを巻き込まない
+type muxChannel struct {
+	idx byte
+	mux *channelMux
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	buf    []byte
+	queue  [][]byte
+	eof    bool
+	closed bool
+}
+
+// deliver 受信したペイロードをこのチャンネルの読み取りキューに積む。
+// 空ペイロードは相手が Close したことを意味するので、キューを閉じて EOF とする。
+// キューは (DropUnread でなければ) 無制限に伸びるので、demux ゴルーチンはここで
+// 決してブロックしない
+func (c *muxChannel) deliver(data []byte, dropUnread bool) {
+	if len(data) == 0 {
+		c.closeChannel()
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.eof {
+		return
+	}
+	if dropUnread && len(c.queue) >= dropUnreadQueueCap {
+		return
+	}
+	c.queue = append(c.queue, data)
+	c.cond.Signal()
+}
+
+func (c *muxChannel) closeChannel() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.eof {
+		c.eof = true
+		c.cond.Broadcast()
+	}
+}
+
+// Read 読み取りキューからデータを取り出す。相手が Close するかフレームが届かなくなると io.EOF を返す
+func (c *muxChannel) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	for len(c.buf) == 0 && len(c.queue) == 0 && !c.eof {
+		c.cond.Wait()
+	}
+	if len(c.buf) == 0 {
+		if len(c.queue) == 0 {
+			c.mu.Unlock()
+			return 0, io.EOF
+		}
+		c.buf, c.queue = c.queue[0], c.queue[1:]
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	c.mu.Unlock()
+	return n, nil
+}
+
+// Write このチャンネル宛てのフレームとして p を送信する
+func (c *muxChannel) Write(p []byte) (int, error) {
+	if err := c.mux.sendFrame(c.idx, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close このチャンネル宛てに空フレームを送り、相手側に EOF を知らせる
+func (c *muxChannel) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.mu.Unlock()
+	return c.mux.sendFrame(c.idx, []byte{})
+}
@@ -0,0 +1,171 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errTimeout = errors.New("timed out waiting for read")
+
+// TestChannelMux は channel.k8s.io 形式で 1 つの WebSocket を複数のチャンネルに
+// 多重化したとき、各チャンネル宛てに書き込んだデータが対応するチャンネルだけに届くことを確認する
+func TestChannelMux(t *testing.T) {
+	var serverChs []io.ReadWriteCloser
+	ready := make(chan struct{})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(res http.ResponseWriter, req *http.Request) {
+		ws, err := AcceptWithOptions(res, req, &AcceptOptions{
+			Subprotocols: []string{ProtocolChannel},
+		})
+		if err != nil {
+			return
+		}
+		for _, c := range ws.Channels(2) {
+			serverChs = append(serverChs, c)
+		}
+		close(ready)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http")
+	client, _, err := Dial(context.Background(), wsURL, &DialOptions{
+		Subprotocols: []string{ProtocolChannel},
+	})
+	if err != nil {
+		t.Fatal("dial failed:", err)
+	}
+	defer client.Close()
+	if client.Subprotocol() != ProtocolChannel {
+		t.Fatalf("subprotocol not negotiated: %q", client.Subprotocol())
+	}
+	clientChs := client.Channels(2)
+	<-ready
+
+	// NewChannelMux は ws.Subscribe の登録が完了してから返るので、最初の Write が
+	// 届くかどうかをリトライする必要はない
+	buf := make([]byte, 64)
+	n, err := writeAndRead(clientChs[0], serverChs[0], []byte("to channel 0"), buf)
+	if err != nil {
+		t.Fatal("channel 0 round trip failed:", err)
+	}
+	if !bytes.Equal(buf[:n], []byte("to channel 0")) {
+		t.Errorf("channel 0 got wrong data: %q", buf[:n])
+	}
+	n, err = writeAndRead(clientChs[1], serverChs[1], []byte("to channel 1"), buf)
+	if err != nil {
+		t.Fatal("channel 1 round trip failed:", err)
+	}
+	if !bytes.Equal(buf[:n], []byte("to channel 1")) {
+		t.Errorf("channel 1 got wrong data: %q", buf[:n])
+	}
+}
+
+// writeAndRead は w に data を 1 回だけ書き込み、r からその結果を読み取るテスト用ヘルパー
+func writeAndRead(w io.Writer, r io.Reader, data, buf []byte) (int, error) {
+	if _, err := w.Write(data); err != nil {
+		return 0, err
+	}
+	return readWithTimeout(r, buf, 2*time.Second)
+}
+
+// TestChannelMuxSubscribesBeforeReturning は、NewChannelMux が返った直後に相手が
+// 書き込んでも、登録が間に合わずフレームが捨てられることがないことを確認する。
+// 以前は demux の Subscribe 登録がゴルーチンの起動タイミング任せだったため、
+// ハンドシェイク直後の書き込みがまれに失われていた
+func TestChannelMuxSubscribesBeforeReturning(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	wsA := new(server, nil, "")
+	wsB := newClient(client, nil, "")
+	defer wsA.Close()
+	defer wsB.Close()
+
+	chsA := NewChannelMux(wsA, 1, nil)
+	chsB := NewChannelMux(wsB, 1, nil)
+
+	const n = 50
+	for i := 0; i < n; i++ {
+		msg := []byte(fmt.Sprintf("msg-%02d", i))
+		if _, err := chsA[0].Write(msg); err != nil {
+			t.Fatal("write failed:", err)
+		}
+		buf := make([]byte, 32)
+		got, err := readWithTimeout(chsB[0], buf, time.Second)
+		if err != nil {
+			t.Fatalf("message %d/%d was not delivered: %v", i+1, n, err)
+		}
+		if string(buf[:got]) != string(msg) {
+			t.Errorf("message %d/%d mismatch: got %q want %q", i+1, n, buf[:got], msg)
+		}
+	}
+}
+
+// TestChannelMuxDeliverDoesNotBlockSiblings は、あるチャンネルの読み手が
+// 全く Read していなくても、別チャンネルへの deliver/Read がブロックされないことを確認する。
+// 以前は全チャンネル共通の 16 要素バッファ付きチャンネルへブロッキング送信しており、
+// 1 チャンネルが詰まると demux ゴルーチンごと他の全チャンネルの配送が止まっていた
+func TestChannelMuxDeliverDoesNotBlockSiblings(t *testing.T) {
+	mux := &channelMux{channels: make([]*muxChannel, 2)}
+	for i := range mux.channels {
+		c := &muxChannel{idx: byte(i), mux: mux}
+		c.cond = sync.NewCond(&c.mu)
+		mux.channels[i] = c
+	}
+
+	// channel 0 を誰も読まないまま溢れさせる
+	for i := 0; i < dropUnreadQueueCap*4; i++ {
+		mux.channels[0].deliver([]byte("stalled"), false)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		mux.channels[1].deliver([]byte("to channel 1"), false)
+		buf := make([]byte, 32)
+		n, err := mux.channels[1].Read(buf)
+		if err != nil {
+			t.Error("channel 1 read failed:", err)
+		} else if string(buf[:n]) != "to channel 1" {
+			t.Errorf("channel 1 got wrong data: %q", buf[:n])
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("channel 1 delivery blocked by stalled channel 0")
+	}
+}
+
+// readWithTimeout は r.Read を別ゴルーチンで実行し、timeout 以内に結果が得られなければ
+// テストをタイムアウトさせず失敗として扱うためのヘルパー
+func readWithTimeout(r io.Reader, buf []byte, timeout time.Duration) (int, error) {
+	type result struct {
+		n   int
+		err error
+	}
+	resCh := make(chan result, 1)
+	go func() {
+		n, err := r.Read(buf)
+		resCh <- result{n, err}
+	}()
+	select {
+	case res := <-resCh:
+		return res.n, res.err
+	case <-time.After(timeout):
+		return 0, errTimeout
+	}
+}
@@ -0,0 +1,194 @@
+package websocket
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestSendClose は SendClose がステータスコードをビッグエンディアン 2 バイトで
+// エンコードし、理由をそれに続けて送ることを確認する
+func TestSendClose(t *testing.T) {
+	h := newHandler()
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http")
+	client, _, err := Dial(context.Background(), wsURL, nil)
+	if err != nil {
+		t.Fatal("dial failed:", err)
+	}
+	defer client.Close()
+
+	// h.ws は別ゴルーチン (ServeHTTP) で代入されるため、受信イベントを
+	// 1 回待って happens-before を確立してから参照する
+	if err := client.SendText("hello"); err != nil {
+		t.Fatal("failed to send text:", err)
+	}
+	<-h.receiveCh
+
+	if err := h.ws.SendClose(CloseGoingAway, "bye"); err != nil {
+		t.Fatal("failed to send close:", err)
+	}
+
+	ce, err := waitForCloseError(client, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ce.Code != CloseGoingAway || ce.Reason != "bye" {
+		t.Errorf("got CloseError{Code: %d, Reason: %q}, want {%d, %q}", ce.Code, ce.Reason, CloseGoingAway, "bye")
+	}
+}
+
+// waitForCloseError は ws.CloseError() が non-nil になるまで待つ。
+// handleClose は受信ゴルーチン内で非同期に呼ばれるため、ポーリングで待ち合わせる
+func waitForCloseError(ws *WebSocket, timeout time.Duration) (*CloseError, error) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if ce := ws.CloseError(); ce != nil {
+			return ce, nil
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return nil, fmt.Errorf("timed out waiting for CloseError")
+}
+
+// TestConcurrentSendDoesNotInterleave は複数ゴルーチンから同時に SendText を
+// 呼んでも、writeMu によってフレームのバイト列が混ざらないことを確認する
+func TestConcurrentSendDoesNotInterleave(t *testing.T) {
+	mux := http.NewServeMux()
+	received := make(chan string, 100)
+	mux.HandleFunc("/", func(res http.ResponseWriter, req *http.Request) {
+		ws, err := Accept(res, req)
+		if err != nil {
+			return
+		}
+		ws.Subscribe(func(ch <-chan Packet) {
+			for pkt := range ch {
+				if pkt.Opcode == OpcodeText {
+					received <- string(pkt.Data)
+				}
+			}
+		})
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http")
+	client, _, err := Dial(context.Background(), wsURL, nil)
+	if err != nil {
+		t.Fatal("dial failed:", err)
+	}
+	defer client.Close()
+
+	const n = 50
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		msg := fmt.Sprintf("message-%02d-xxxxxxxxxxxxxxxxxxxx", i)
+		go func(msg string) {
+			defer wg.Done()
+			if err := client.SendText(msg); err != nil {
+				t.Error("SendText failed:", err)
+			}
+		}(msg)
+	}
+	wg.Wait()
+
+	want := make(map[string]bool, n)
+	for i := 0; i < n; i++ {
+		want[fmt.Sprintf("message-%02d-xxxxxxxxxxxxxxxxxxxx", i)] = true
+	}
+	for i := 0; i < n; i++ {
+		select {
+		case got := <-received:
+			if !want[got] {
+				t.Errorf("unexpected or corrupted message: %q", got)
+			}
+			delete(want, got)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for message %d/%d, missing: %v", i+1, n, want)
+		}
+	}
+}
+
+// TestCloseIsIdempotent は Close を複数回呼んでもパニックしないことを確認する。
+// handleClose が close ハンドシェイクの一環として Close を呼ぶようになったため、
+// 呼び出し側の defer ws.Close() と競合するのは珍しいことではなくなった
+func TestCloseIsIdempotent(t *testing.T) {
+	h := newHandler()
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http")
+	client, _, err := Dial(context.Background(), wsURL, nil)
+	if err != nil {
+		t.Fatal("dial failed:", err)
+	}
+
+	go client.Subscribe(func(ch <-chan Packet) {
+		for range ch {
+		}
+	})
+
+	if err := client.Close(); err != nil {
+		t.Fatal("first Close failed:", err)
+	}
+	if err := client.Close(); err != nil {
+		t.Fatal("second Close failed:", err)
+	}
+}
+
+// TestSendStreamBlocksOtherDataFrames は、SendStreamSize で開始した分割メッセージが
+// Close されるまで、同じ WebSocket からの他のデータフレーム送信 (SendText) が
+// ブロックされることを確認する。RFC 6455 5.4 は、分割メッセージの途中に別のデータ
+// フレームを割り込ませることを禁じている
+func TestSendStreamBlocksOtherDataFrames(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	wsA := new(server, nil, "")
+	wsB := newClient(client, nil, "")
+	defer wsA.Close()
+	defer wsB.Close()
+	go wsB.Subscribe(func(ch <-chan Packet) {
+		for range ch {
+		}
+	})
+
+	w := wsA.SendStreamSize(OpcodeText, 2)
+	if _, err := w.Write([]byte("ab")); err != nil {
+		t.Fatal("failed to write stream chunk:", err)
+	}
+
+	interruptDone := make(chan error, 1)
+	go func() {
+		interruptDone <- wsA.SendText("interrupt")
+	}()
+
+	select {
+	case err := <-interruptDone:
+		t.Fatalf("SendText returned before the stream was closed (err=%v); it should have been blocked", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal("failed to close stream:", err)
+	}
+
+	select {
+	case err := <-interruptDone:
+		if err != nil {
+			t.Error("SendText failed after stream closed:", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("SendText still blocked after the stream was closed")
+	}
+}
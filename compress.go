@@ -0,0 +1,235 @@
+package websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"strings"
+	"sync"
+)
+
+// extensionPermessageDeflate Sec-WebSocket-Extensions で使われる拡張名
+const extensionPermessageDeflate = "permessage-deflate"
+
+// DefaultMinCompressSize PermessageDeflateOptions.MinCompressSize を指定しなかった場合に使うしきい値
+const DefaultMinCompressSize = 1024
+
+// deflateTail permessage-deflate で送受信時に付け外しする同期フラッシュの末尾 4 バイト
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff}
+
+// pmdMaxWindow server_max_window_bits / client_max_window_bits を指定しなかったときの
+// 既定のスライディングウィンドウサイズ (RFC 7692 7.1.2.1 / 7.1.2.2)
+const pmdMaxWindow = 32768
+
+// PermessageDeflateOptions permessage-deflate (RFC 7692) 拡張の設定
+type PermessageDeflateOptions struct {
+	// Enabled permessage-deflate を有効にするかどうか
+	Enabled bool
+	// NoContextTakeover true のとき、送信するメッセージ毎に圧縮コンテキストをリセットする
+	NoContextTakeover bool
+	// MinCompressSize この値未満のペイロードは圧縮せずそのまま送信する。0 のときは DefaultMinCompressSize を使う
+	MinCompressSize int
+}
+
+func (o PermessageDeflateOptions) minCompressSize() int {
+	if o.MinCompressSize > 0 {
+		return o.MinCompressSize
+	}
+	return DefaultMinCompressSize
+}
+
+// pmdNegotiated 接続で合意した permessage-deflate のパラメータ
+type pmdNegotiated struct {
+	serverNoContextTakeover bool
+	clientNoContextTakeover bool
+}
+
+// parseExtensionToken "name; p1; p2=v2" のようなトークンを名前とパラメータに分解する
+func parseExtensionToken(raw string) (string, map[string]string) {
+	parts := strings.Split(raw, ";")
+	name := strings.TrimSpace(parts[0])
+	params := map[string]string{}
+	for _, p := range parts[1:] {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if i := strings.Index(p, "="); i >= 0 {
+			params[strings.TrimSpace(p[:i])] = strings.Trim(strings.TrimSpace(p[i+1:]), "\"")
+		} else {
+			params[p] = ""
+		}
+	}
+	return name, params
+}
+
+// negotiatePermessageDeflateOffer サーバー側で、クライアントが送ってきた
+// Sec-WebSocket-Extensions ヘッダから permessage-deflate を合意する。
+// 合意できなかったときは ok が false になる。
+func negotiatePermessageDeflateOffer(header string, opts PermessageDeflateOptions) (pmdNegotiated, string, bool) {
+	if !opts.Enabled || header == "" {
+		return pmdNegotiated{}, "", false
+	}
+	for _, offer := range strings.Split(header, ",") {
+		name, params := parseExtensionToken(offer)
+		if name != extensionPermessageDeflate {
+			continue
+		}
+		_, clientAskedServerNCT := params["server_no_context_takeover"]
+		_, clientToldClientNCT := params["client_no_context_takeover"]
+		neg := pmdNegotiated{
+			// サーバー自身の送信については、クライアントから明示的に要求されたか、
+			// サーバー自身がコンテキストテイクオーバーに対応しない設定のときだけリセットする。
+			// それ以外はコンテキストテイクオーバーを維持し、圧縮率を稼ぐ
+			serverNoContextTakeover: clientAskedServerNCT || opts.NoContextTakeover,
+			// クライアントの送信については、クライアントが申告した内容をそのまま記録する
+			clientNoContextTakeover: clientToldClientNCT,
+		}
+		response := []string{extensionPermessageDeflate}
+		if neg.serverNoContextTakeover {
+			response = append(response, "server_no_context_takeover")
+		}
+		if neg.clientNoContextTakeover {
+			response = append(response, "client_no_context_takeover")
+		}
+		if v, ok := params["server_max_window_bits"]; ok {
+			response = append(response, "server_max_window_bits="+v)
+		}
+		if v, ok := params["client_max_window_bits"]; ok {
+			response = append(response, "client_max_window_bits="+v)
+		}
+		return neg, strings.Join(response, "; "), true
+	}
+	return pmdNegotiated{}, "", false
+}
+
+// parsePermessageDeflateResponse クライアント側で、サーバーが返してきた
+// Sec-WebSocket-Extensions ヘッダから合意内容を読み取る
+func parsePermessageDeflateResponse(header string) (pmdNegotiated, bool) {
+	if header == "" {
+		return pmdNegotiated{}, false
+	}
+	for _, token := range strings.Split(header, ",") {
+		name, params := parseExtensionToken(token)
+		if name != extensionPermessageDeflate {
+			continue
+		}
+		neg := pmdNegotiated{}
+		if _, ok := params["server_no_context_takeover"]; ok {
+			neg.serverNoContextTakeover = true
+		}
+		if _, ok := params["client_no_context_takeover"]; ok {
+			neg.clientNoContextTakeover = true
+		}
+		return neg, true
+	}
+	return pmdNegotiated{}, false
+}
+
+// pmdState 1 つの WebSocket 接続における permessage-deflate の圧縮・伸張コンテキスト。
+// sendNoContextTakeover / recvNoContextTakeover が false のときは、直前のメッセージの
+// スライディングウィンドウ (最大 pmdMaxWindow バイト) をプリセット辞書として次のメッセージの
+// flate.Writer / flate.Reader に渡すことで、本物のコンテキストテイクオーバーを行う
+type pmdState struct {
+	opts PermessageDeflateOptions
+
+	// sendNoContextTakeover このプロセスが送信するメッセージ毎に圧縮コンテキストをリセットするか
+	sendNoContextTakeover bool
+	// recvNoContextTakeover このプロセスが受信するメッセージ毎に伸張コンテキストをリセットするか
+	recvNoContextTakeover bool
+
+	writeMu sync.Mutex
+	readMu  sync.Mutex
+
+	// sendDict/recvDict 直前までのメッセージの生データ末尾 (最大 pmdMaxWindow バイト)。
+	// no_context_takeover が有効な側は常に空のままになる
+	sendDict []byte
+	recvDict []byte
+}
+
+// pushWindow dict の末尾に data を足し、pmdMaxWindow バイトを超えた分を切り捨てる
+func pushWindow(dict, data []byte) []byte {
+	dict = append(dict, data...)
+	if len(dict) > pmdMaxWindow {
+		dict = dict[len(dict)-pmdMaxWindow:]
+	}
+	return dict
+}
+
+// newPMDState 合意内容から pmdState を作る。isServer はこのプロセスがサーバーかどうか
+func newPMDState(opts PermessageDeflateOptions, neg pmdNegotiated, isServer bool) *pmdState {
+	p := &pmdState{opts: opts}
+	if isServer {
+		p.sendNoContextTakeover = neg.serverNoContextTakeover
+		p.recvNoContextTakeover = neg.clientNoContextTakeover
+	} else {
+		p.sendNoContextTakeover = neg.clientNoContextTakeover
+		p.recvNoContextTakeover = neg.serverNoContextTakeover
+	}
+	return p
+}
+
+// compress data を permessage-deflate 形式 (同期フラッシュの末尾 4 バイトを除いたもの) に圧縮する。
+// sendNoContextTakeover でなければ、直前のメッセージのウィンドウをプリセット辞書として使い、
+// 圧縮後は data で辞書を更新してコンテキストを引き継ぐ
+func (p *pmdState) compress(data []byte) ([]byte, error) {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	var buf bytes.Buffer
+	w, err := flate.NewWriterDict(&buf, flate.DefaultCompression, p.sendDict)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	if p.sendNoContextTakeover {
+		p.sendDict = nil
+	} else {
+		p.sendDict = pushWindow(p.sendDict, data)
+	}
+	out := bytes.TrimSuffix(buf.Bytes(), deflateTail)
+	ret := make([]byte, len(out))
+	copy(ret, out)
+	return ret, nil
+}
+
+// decompress permessage-deflate 形式で圧縮されたペイロードを伸張する。
+// recvNoContextTakeover でなければ、直前のメッセージのウィンドウをプリセット辞書として使い、
+// 伸張後はその結果で辞書を更新してコンテキストを引き継ぐ
+func (p *pmdState) decompress(data []byte) ([]byte, error) {
+	p.readMu.Lock()
+	defer p.readMu.Unlock()
+	full := make([]byte, 0, len(data)+len(deflateTail))
+	full = append(full, data...)
+	full = append(full, deflateTail...)
+	r := flate.NewReaderDict(bytes.NewReader(full), p.recvDict)
+	defer r.Close()
+	var out bytes.Buffer
+	buf := make([]byte, 4096)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			out.Write(buf[:n])
+		}
+		if err != nil {
+			// 末尾に付け直した 0x00 0x00 0xff 0xff は「このメッセージ分の入力はここまで」
+			// という意味の同期フラッシュなので、flate.Reader は次のブロックを読もうとして
+			// 本当の意味でのストリーム終端を表す io.EOF だけでなく io.ErrUnexpectedEOF を
+			// 返すことがある。どちらもこのメッセージの終わりとして扱ってよい
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return nil, err
+		}
+	}
+	if p.recvNoContextTakeover {
+		p.recvDict = nil
+	} else {
+		p.recvDict = pushWindow(p.recvDict, out.Bytes())
+	}
+	return out.Bytes(), nil
+}
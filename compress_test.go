@@ -0,0 +1,127 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestPermessageDeflateRoundTrip は permessage-deflate を有効にした Accept / Dial
+// の組み合わせで、RSV1 を立てて圧縮されたメッセージが正しく伸張されて届くことを確認する
+func TestPermessageDeflateRoundTrip(t *testing.T) {
+	h := newHandler()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(res http.ResponseWriter, req *http.Request) {
+		ws, err := AcceptWithOptions(res, req, &AcceptOptions{
+			PermessageDeflate: PermessageDeflateOptions{Enabled: true},
+		})
+		if err != nil {
+			h.ch <- err
+			req.Body.Close()
+			return
+		}
+		h.ws = ws
+		ws.Subscribe(func(ch <-chan Packet) {
+			for pkt := range ch {
+				if pkt.Opcode == OpcodeText {
+					h.texts = append(h.texts, string(pkt.Data))
+					h.receiveCh <- 0
+				}
+			}
+		})
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http")
+	client, _, err := Dial(context.Background(), wsURL, &DialOptions{
+		PermessageDeflate: PermessageDeflateOptions{Enabled: true},
+	})
+	if err != nil {
+		t.Fatal("dial failed:", err)
+	}
+	defer client.Close()
+	if client.pmd == nil {
+		t.Fatal("client did not negotiate permessage-deflate")
+	}
+
+	// MinCompressSize (既定 1024 バイト) 以上の、圧縮が効く繰り返しの多いメッセージを送る
+	msg := strings.Repeat("permessage-deflate round trip ", 100)
+	if err := client.SendText(msg); err != nil {
+		t.Fatal("failed to send text:", err)
+	}
+	<-h.receiveCh
+	if len(h.texts) != 1 || h.texts[0] != msg {
+		t.Errorf("decompressed message mismatch: got %d bytes, want %d bytes", len(h.texts[0]), len(msg))
+	}
+
+	// サーバーからクライアントへの圧縮メッセージも確認する (この向きでは最初のメッセージなので、
+	// プリセット辞書なしで伸張される)
+	done := make(chan Packet, 1)
+	ready := make(chan struct{})
+	go client.Subscribe(func(ch <-chan Packet) {
+		close(ready)
+		for pkt := range ch {
+			done <- pkt
+			return
+		}
+	})
+	<-ready
+	if err := h.ws.SendText(msg); err != nil {
+		t.Fatal("failed to send text from server:", err)
+	}
+	pkt := <-done
+	if !bytes.Equal(pkt.Data, []byte(msg)) {
+		t.Errorf("client decompressed message mismatch: got %d bytes, want %d bytes", len(pkt.Data), len(msg))
+	}
+}
+
+// TestPMDStateContextTakeover は no_context_takeover が合意されていないとき、直前の
+// メッセージのウィンドウが次のメッセージの圧縮・伸張のプリセット辞書として使われ、
+// (1) 繰り返しメッセージの圧縮結果が 2 通信目以降で小さくなり、(2) 受信側もその辞書を
+// 前提に正しく伸張できることを確認する。no_context_takeover が合意されているときは、
+// 辞書を使い回さないので圧縮結果のサイズが変わらないことも確認する
+func TestPMDStateContextTakeover(t *testing.T) {
+	msg := []byte(strings.Repeat("permessage-deflate context takeover ", 20))
+
+	sender := newPMDState(PermessageDeflateOptions{Enabled: true}, pmdNegotiated{}, true)
+	receiver := newPMDState(PermessageDeflateOptions{Enabled: true}, pmdNegotiated{}, false)
+	first, err := sender.compress(msg)
+	if err != nil {
+		t.Fatal("compress failed:", err)
+	}
+	second, err := sender.compress(msg)
+	if err != nil {
+		t.Fatal("compress failed:", err)
+	}
+	if len(second) >= len(first) {
+		t.Errorf("expected context takeover to shrink repeated message: first=%d second=%d", len(first), len(second))
+	}
+	for _, compressed := range [][]byte{first, second} {
+		out, err := receiver.decompress(compressed)
+		if err != nil {
+			t.Fatal("decompress failed:", err)
+		}
+		if !bytes.Equal(out, msg) {
+			t.Errorf("decompressed message mismatch: got %q, want %q", out, msg)
+		}
+	}
+
+	noTakeover := newPMDState(PermessageDeflateOptions{Enabled: true}, pmdNegotiated{
+		serverNoContextTakeover: true,
+	}, true)
+	first, err = noTakeover.compress(msg)
+	if err != nil {
+		t.Fatal("compress failed:", err)
+	}
+	second, err = noTakeover.compress(msg)
+	if err != nil {
+		t.Fatal("compress failed:", err)
+	}
+	if len(second) != len(first) {
+		t.Errorf("expected no_context_takeover to keep message size stable: first=%d second=%d", len(first), len(second))
+	}
+}
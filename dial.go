@@ -0,0 +1,172 @@
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// DialOptions Dial の挙動を設定するオプション
+type DialOptions struct {
+	// TLSConfig wss:// で接続する際に使用する tls.Config。nil のときは既定値を使う
+	TLSConfig *tls.Config
+	// Header ハンドシェイクリクエストに追加する HTTP ヘッダ
+	Header http.Header
+	// Subprotocols Sec-WebSocket-Protocol として送るサブプロトコルの候補
+	Subprotocols []string
+	// PermessageDeflate permessage-deflate 拡張の設定
+	PermessageDeflate PermessageDeflateOptions
+}
+
+// Dial WebSocket サーバーに接続し、ハンドシェイクを行って WebSocket 接続を確立する。
+// urlStr は ws:// か wss:// で始まる URL でなければならない。
+// ハンドシェイクに使ったレスポンスは成否にかかわらず res として返す。
+func Dial(ctx context.Context, urlStr string, opts *DialOptions) (*WebSocket, *http.Response, error) {
+	if opts == nil {
+		opts = &DialOptions{}
+	}
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse url: %w", err)
+	}
+
+	var httpScheme string
+	var defaultPort string
+	switch u.Scheme {
+	case "ws":
+		httpScheme = "http"
+		defaultPort = "80"
+	case "wss":
+		httpScheme = "https"
+		defaultPort = "443"
+	default:
+		return nil, nil, fmt.Errorf("unsupported scheme: %s", u.Scheme)
+	}
+
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), defaultPort)
+	}
+
+	conn, err := dialConn(ctx, httpScheme, addr, u.Hostname(), opts.TLSConfig)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to dial: %w", err)
+	}
+
+	secKeyRaw := make([]byte, 16)
+	if _, err := rand.Read(secKeyRaw); err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("failed to generate %s: %w", SecWebSocketKey, err)
+	}
+	secKey := base64.StdEncoding.EncodeToString(secKeyRaw)
+
+	if err := writeHandshakeRequest(conn, u, secKey, opts); err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("failed to write handshake request: %w", err)
+	}
+
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, &http.Request{Method: http.MethodGet, URL: u})
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("failed to read handshake response: %w", err)
+	}
+	if err := validateHandshakeResponse(res, secKey); err != nil {
+		conn.Close()
+		return nil, res, err
+	}
+
+	var pmd *pmdState
+	if opts.PermessageDeflate.Enabled {
+		if neg, ok := parsePermessageDeflateResponse(res.Header.Get("Sec-WebSocket-Extensions")); ok {
+			pmd = newPMDState(opts.PermessageDeflate, neg, false)
+		}
+	}
+	ws := newClient(&bufConn{Conn: conn, r: br}, pmd, res.Header.Get("Sec-WebSocket-Protocol"))
+	return ws, res, nil
+}
+
+func dialConn(ctx context.Context, httpScheme, addr, serverName string, tlsConfig *tls.Config) (net.Conn, error) {
+	if httpScheme != "https" {
+		return (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	}
+	conf := tlsConfig
+	if conf == nil {
+		conf = &tls.Config{}
+	}
+	if conf.ServerName == "" {
+		conf = conf.Clone()
+		conf.ServerName = serverName
+	}
+	return (&tls.Dialer{Config: conf}).DialContext(ctx, "tcp", addr)
+}
+
+func writeHandshakeRequest(conn net.Conn, u *url.URL, secKey string, opts *DialOptions) error {
+	header := http.Header{}
+	for k, v := range opts.Header {
+		header[k] = v
+	}
+	header.Set("Host", u.Host)
+	header.Set("Upgrade", "websocket")
+	header.Set("Connection", "Upgrade")
+	header.Set(SecWebSocketKey, secKey)
+	header.Set("Sec-WebSocket-Version", "13")
+	if len(opts.Subprotocols) > 0 {
+		header.Set("Sec-WebSocket-Protocol", strings.Join(opts.Subprotocols, ", "))
+	}
+	if opts.PermessageDeflate.Enabled {
+		offer := extensionPermessageDeflate
+		if opts.PermessageDeflate.NoContextTakeover {
+			offer += "; client_no_context_takeover"
+		}
+		header.Set("Sec-WebSocket-Extensions", offer)
+	}
+
+	requestURI := u.RequestURI()
+	if requestURI == "" {
+		requestURI = "/"
+	}
+	lines := []string{fmt.Sprintf("GET %s HTTP/1.1", requestURI)}
+	for k := range header {
+		lines = append(lines, k+": "+header.Get(k))
+	}
+	lines = append(lines, "", "")
+	_, err := conn.Write([]byte(strings.Join(lines, "\r\n")))
+	return err
+}
+
+func validateHandshakeResponse(res *http.Response, secKey string) error {
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		return fmt.Errorf("unexpected status code: %d", res.StatusCode)
+	}
+	if !strings.EqualFold(res.Header.Get("Upgrade"), "websocket") {
+		return errors.New("response Upgrade header is not websocket")
+	}
+	if !strings.EqualFold(res.Header.Get("Connection"), "Upgrade") {
+		return errors.New("response Connection header is not Upgrade")
+	}
+	if res.Header.Get(SecWebSocketAccept) != CreateSecWebSocketAccept(secKey) {
+		return errors.New("invalid " + SecWebSocketAccept)
+	}
+	return nil
+}
+
+// bufConn は net.Conn に bufio.Reader を被せ、ハンドシェイクレスポンスの
+// 読み取り時にバッファへ先読みされてしまったフレームのバイト列を
+// 取りこぼさないようにするためのラッパー
+type bufConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -0,0 +1,65 @@
+package websocket
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestDial は Dial を使ったクライアント側ハンドシェイクと、
+// クライアントが送るフレームが RFC 6455 どおりマスクされていることを確認する
+func TestDial(t *testing.T) {
+	h := newHandler()
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http")
+	client, res, err := Dial(context.Background(), wsURL, nil)
+	if err != nil {
+		t.Fatal("dial failed:", err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Error("unexpected status code:", res.StatusCode)
+	}
+
+	if err := client.SendText("hello from client"); err != nil {
+		t.Fatal("failed to send text:", err)
+	}
+	<-h.receiveCh
+	if len(h.texts) != 1 || h.texts[0] != "hello from client" {
+		t.Error("server did not receive masked client frame correctly:", h.texts)
+	}
+
+	done := make(chan Packet, 1)
+	ready := make(chan struct{})
+	go client.Subscribe(func(ch <-chan Packet) {
+		close(ready)
+		for pkt := range ch {
+			done <- pkt
+			return
+		}
+	})
+	<-ready
+	if err := h.ws.SendText("hello from server"); err != nil {
+		t.Fatal("failed to send text from server:", err)
+	}
+	pkt := <-done
+	if string(pkt.Data) != "hello from server" {
+		t.Error("client did not receive server frame correctly:", pkt.Data)
+	}
+
+	client.Shutdown()
+	<-h.receiveCh
+	if !h.closed {
+		t.Error("close not work")
+	}
+}
+
+// TestDialInvalidScheme は ws:// / wss:// 以外のスキームを拒否することを確認する
+func TestDialInvalidScheme(t *testing.T) {
+	if _, _, err := Dial(context.Background(), "http://example.com", nil); err == nil {
+		t.Error("expected error for unsupported scheme")
+	}
+}
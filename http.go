@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 )
@@ -22,51 +23,211 @@ const (
 	SecWebSocketAccept = "Sec-WebSocket-Accept"
 )
 
-// Accept HTTP 接続を WebSocket 接続に切り替える。
+// Upgrader HTTP 接続を WebSocket 接続にアップグレードする際の挙動を設定する
+type Upgrader struct {
+	// CheckOrigin Origin ヘッダを許可するかどうかを判定する関数。
+	// nil のときは checkSameOrigin (Origin が空か、Host と同一のときのみ許可) を使う
+	CheckOrigin func(r *http.Request) bool
+	// Subprotocols サーバーが対応しているサブプロトコルの候補。優先度が高い順に並べる
+	Subprotocols []string
+	// PermessageDeflate permessage-deflate 拡張の設定
+	PermessageDeflate PermessageDeflateOptions
+	// HandshakeTimeout Hijack からレスポンス送信までに許す時間。0 のときは無制限
+	HandshakeTimeout time.Duration
+	// ReadBufferSize Hijack 後、残っている読み込みバッファを読み捨てる際に使うバッファサイズ。
+	// 0 のときは既定のサイズを使う
+	ReadBufferSize int
+	// WriteBufferSize 現状は予約されているだけで未使用 (gorilla 等との互換のために用意している)
+	WriteBufferSize int
+	// Error ハンドシェイクを拒否するときに呼ばれる。nil のときは既定の実装 (http.Error) を使う
+	Error func(w http.ResponseWriter, r *http.Request, status int, reason error)
+}
+
+// DefaultUpgrader Accept が使う既定の Upgrader
+var DefaultUpgrader = &Upgrader{}
+
+// Accept HTTP 接続を WebSocket 接続に切り替える。DefaultUpgrader.Upgrade の薄いラッパー。
 // 切り替えに失敗したときは、呼び出し側が ResponseWriter.Body.Close() を呼ぶ必要がある。
 // 切り替えに成功したときは、 ResponseWriter.Body.Close() を呼ばないこと。
 func Accept(res http.ResponseWriter, req *http.Request) (*WebSocket, error) {
-	// WebSocket 化リクエストの確認
+	return DefaultUpgrader.Upgrade(res, req)
+}
+
+// AcceptOptions AcceptWithOptions の挙動を設定するオプション
+type AcceptOptions struct {
+	// PermessageDeflate permessage-deflate 拡張の設定
+	PermessageDeflate PermessageDeflateOptions
+	// Subprotocols サーバーが対応しているサブプロトコルの候補。優先度が高い順に並べる
+	Subprotocols []string
+}
+
+// AcceptWithOptions Accept の拡張版。より細かく設定したいときは Upgrader を直接使うこと。
+func AcceptWithOptions(res http.ResponseWriter, req *http.Request, opts *AcceptOptions) (*WebSocket, error) {
+	if opts == nil {
+		opts = &AcceptOptions{}
+	}
+	u := &Upgrader{
+		PermessageDeflate: opts.PermessageDeflate,
+		Subprotocols:      opts.Subprotocols,
+	}
+	return u.Upgrade(res, req)
+}
+
+// Upgrade HTTP 接続を検証し、問題なければ WebSocket 接続に切り替える。
+// Upgrade: websocket / Connection: upgrade / Sec-WebSocket-Version: 13 であることを確認し、
+// CheckOrigin で Origin を確認したうえで、Subprotocols / PermessageDeflate をネゴシエートする。
+// 検証に失敗したときは Error (既定では http.Error) で 405 (GET 以外) / 400 / 426 / 403 のいずれかを、
+// ResponseWriter が http.Hijacker を実装していないときは 500 を応答する。
+func (u *Upgrader) Upgrade(res http.ResponseWriter, req *http.Request) (*WebSocket, error) {
+	errorFunc := u.Error
+	if errorFunc == nil {
+		errorFunc = defaultUpgradeError
+	}
+	fail := func(status int, reason error) (*WebSocket, error) {
+		errorFunc(res, req, status, reason)
+		return nil, reason
+	}
+
+	if req.Method != http.MethodGet {
+		return fail(http.StatusMethodNotAllowed, errors.New("method is not GET"))
+	}
+	if !headerContainsToken(req.Header.Get("Connection"), "upgrade") {
+		return fail(http.StatusBadRequest, errors.New("Connection header does not contain upgrade"))
+	}
+	if !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		return fail(http.StatusBadRequest, errors.New("Upgrade header is not websocket"))
+	}
+	if req.Header.Get("Sec-WebSocket-Version") != "13" {
+		res.Header().Set("Sec-WebSocket-Version", "13")
+		return fail(http.StatusUpgradeRequired, errors.New("unsupported Sec-WebSocket-Version"))
+	}
 	secKey := req.Header.Get(SecWebSocketKey)
-	if len(secKey) != 24 {
-		return nil, errors.New("invalid " + SecWebSocketKey)
+	if !validSecWebSocketKey(secKey) {
+		return fail(http.StatusBadRequest, errors.New("invalid "+SecWebSocketKey))
+	}
+	checkOrigin := u.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = checkSameOrigin
 	}
+	if !checkOrigin(req) {
+		return fail(http.StatusForbidden, errors.New("request Origin is not allowed"))
+	}
+
+	pmdNeg, pmdResponse, pmdOK := negotiatePermessageDeflateOffer(req.Header.Get("Sec-WebSocket-Extensions"), u.PermessageDeflate)
+	protocol := negotiateSubprotocol(req.Header.Get("Sec-WebSocket-Protocol"), u.Subprotocols)
 
 	// HTTP 通信を HTTP でなくす
 	hijacker, ok := res.(http.Hijacker)
 	if !ok {
-		return nil, errors.New("ResponseWriter not implement Hijacker")
+		return fail(http.StatusInternalServerError, errors.New("ResponseWriter not implement Hijacker"))
 	}
 	conn, rw, err := hijacker.Hijack()
 	if err != nil {
 		return nil, fmt.Errorf("failed to hijack: %w", err)
 	}
+	if u.HandshakeTimeout > 0 {
+		if err := conn.SetDeadline(time.Now().Add(u.HandshakeTimeout)); err != nil {
+			log.Println("info: websocket.Upgrade: failed to SetDeadline for handshake timeout:", err)
+		}
+		defer func() {
+			if err := conn.SetDeadline(time.Time{}); err != nil {
+				log.Println("info: websocket.Upgrade: failed to clear handshake deadline:", err)
+			}
+		}()
+	}
 
 	// 読み込みバッファ掃除
 	// Read をブロックさせないようにして、バッファが空になるまで Read する
 	if err := conn.SetReadDeadline(time.Now().Add(time.Millisecond)); err != nil {
-		log.Println("info: websocket.Accept: failed to SetReadDeadline to 1ms:", err)
+		log.Println("info: websocket.Upgrade: failed to SetReadDeadline to 1ms:", err)
 	}
-	emptyReadBuffer(rw)
+	emptyReadBuffer(rw, u.ReadBufferSize)
 	if err := conn.SetReadDeadline(time.Time{}); err != nil {
-		log.Println("info: websocket.Accept: failed to SetReadDeadline to 0:", err)
+		log.Println("info: websocket.Upgrade: failed to SetReadDeadline to 0:", err)
 	}
 
 	// WebSocket 通信を確立する
 	secAccept := CreateSecWebSocketAccept(secKey)
-	responseData := []byte(strings.Join([]string{
+	responseLines := []string{
 		"HTTP/1.1 101 Switching Protocols",
 		"Upgrade: websocket",
 		"Connection: Upgrade",
 		"Sec-WebSocket-Accept: " + secAccept,
-		"",
-		"",
-	}, "\r\n"))
-	if _, err := conn.Write(responseData); err != nil {
+	}
+	if pmdOK {
+		responseLines = append(responseLines, "Sec-WebSocket-Extensions: "+pmdResponse)
+	}
+	if protocol != "" {
+		responseLines = append(responseLines, "Sec-WebSocket-Protocol: "+protocol)
+	}
+	responseLines = append(responseLines, "", "")
+	if _, err := conn.Write([]byte(strings.Join(responseLines, "\r\n"))); err != nil {
 		conn.Close()
 		return nil, fmt.Errorf("failed to write response (switching protocol): %w", err)
 	}
-	return new(conn), nil
+
+	var pmd *pmdState
+	if pmdOK {
+		pmd = newPMDState(u.PermessageDeflate, pmdNeg, true)
+	}
+	return new(conn, pmd, protocol), nil
+}
+
+// defaultUpgradeError Upgrader.Error の既定の実装。reason をそのまま本文にして status を返す
+func defaultUpgradeError(w http.ResponseWriter, r *http.Request, status int, reason error) {
+	http.Error(w, reason.Error(), status)
+}
+
+// checkSameOrigin Upgrader.CheckOrigin の既定の実装。
+// Origin ヘッダがないとき、または Origin の Host がリクエスト先の Host と一致するときのみ許可する
+func checkSameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// headerContainsToken header がカンマ区切りのトークンのリストとして token (大文字小文字区別なし) を含むか調べる
+func headerContainsToken(header, token string) bool {
+	for _, v := range strings.Split(header, ",") {
+		if strings.EqualFold(strings.TrimSpace(v), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// validSecWebSocketKey Sec-WebSocket-Key ヘッダが 16 バイトを base64 エンコードしたものかどうか検証する
+func validSecWebSocketKey(key string) bool {
+	if len(key) != 24 {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	return err == nil && len(decoded) == 16
+}
+
+// negotiateSubprotocol header (クライアントの Sec-WebSocket-Protocol) と supported
+// (サーバーが対応しているサブプロトコル、優先度が高い順) を突き合わせ、最初に一致したものを返す。
+// 一致するものがなければ空文字列を返す
+func negotiateSubprotocol(header string, supported []string) string {
+	if header == "" || len(supported) == 0 {
+		return ""
+	}
+	requested := map[string]bool{}
+	for _, p := range strings.Split(header, ",") {
+		requested[strings.TrimSpace(p)] = true
+	}
+	for _, p := range supported {
+		if requested[p] {
+			return p
+		}
+	}
+	return ""
 }
 
 // CreateSecWebSocketAccept Sec-WebSocket-Accept ヘッダを計算する
@@ -79,15 +240,18 @@ func CreateSecWebSocketAccept(secWebSocketKey string) string {
 	return string(buf)
 }
 
-func emptyReadBuffer(rw *bufio.ReadWriter) {
-	buf := make([]byte, 4096)
+func emptyReadBuffer(rw *bufio.ReadWriter, bufSize int) {
+	if bufSize <= 0 {
+		bufSize = 4096
+	}
+	buf := make([]byte, bufSize)
 	for {
 		n, e := rw.Read(buf)
 		if n == 0 {
 			break
 		}
 		if e != nil {
-			log.Println("info: websocket.Accept: read data, but error occurred while read:", e)
+			log.Println("info: websocket.Upgrade: read data, but error occurred while read:", e)
 		}
 	}
 }
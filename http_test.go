@@ -0,0 +1,126 @@
+package websocket
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestUpgradeRejectsInvalidRequests は Upgrade がハンドシェイクとして不正なリクエストを
+// 期待どおりのステータスコードで拒否することを確認する
+func TestUpgradeRejectsInvalidRequests(t *testing.T) {
+	u := &Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if _, err := u.Upgrade(res, req); err != nil {
+			req.Body.Close()
+		}
+	}))
+	defer srv.Close()
+
+	validHeaders := func(req *http.Request) {
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Sec-WebSocket-Version", "13")
+		req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		mutate     func(req *http.Request)
+		wantStatus int
+	}{
+		{
+			name:       "wrong method",
+			method:     http.MethodPost,
+			mutate:     validHeaders,
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			name:   "missing Connection upgrade",
+			method: http.MethodGet,
+			mutate: func(req *http.Request) {
+				validHeaders(req)
+				req.Header.Set("Connection", "keep-alive")
+			},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "Upgrade header is not websocket",
+			method: http.MethodGet,
+			mutate: func(req *http.Request) {
+				validHeaders(req)
+				req.Header.Set("Upgrade", "h2c")
+			},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "unsupported version",
+			method: http.MethodGet,
+			mutate: func(req *http.Request) {
+				validHeaders(req)
+				req.Header.Set("Sec-WebSocket-Version", "8")
+			},
+			wantStatus: http.StatusUpgradeRequired,
+		},
+		{
+			name:   "invalid Sec-WebSocket-Key",
+			method: http.MethodGet,
+			mutate: func(req *http.Request) {
+				validHeaders(req)
+				req.Header.Set("Sec-WebSocket-Key", "too-short")
+			},
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, srv.URL, nil)
+			if err != nil {
+				t.Fatal("failed to build request:", err)
+			}
+			tt.mutate(req)
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal("request failed:", err)
+			}
+			defer res.Body.Close()
+			if res.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", res.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+}
+
+// TestUpgradeCheckOrigin は CheckOrigin が false を返したときに
+// Upgrade がハンドシェイクを 403 で拒否することを確認する
+func TestUpgradeCheckOrigin(t *testing.T) {
+	u := &Upgrader{
+		CheckOrigin: func(r *http.Request) bool { return false },
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if _, err := u.Upgrade(res, req); err != nil {
+			req.Body.Close()
+		}
+	}))
+	defer srv.Close()
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+	if err != nil {
+		t.Fatal("failed to build request:", err)
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Origin", "https://evil.example.com")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("request failed:", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("status = %d, want %d", res.StatusCode, http.StatusForbidden)
+	}
+}
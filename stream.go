@@ -0,0 +1,204 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"time"
+)
+
+// Mode PipeFrom / Sink が使うフレーミングの種類
+type Mode int
+
+const (
+	// ModeLines 入力を改行区切りで読み、1 行ごと (改行は含まない) にテキストフレームとして送信する
+	ModeLines Mode = iota
+	// ModeText バッファが BufSize に達するかフラッシュ間隔が経過するごとにテキストフレームとして送信する
+	ModeText
+	// ModeBinary ModeText と同様だがバイナリフレームとして送信する
+	ModeBinary
+)
+
+// DefaultStreamBufSize PipeFrom / Sink がバッファサイズを指定しなかった場合に使うサイズ
+const DefaultStreamBufSize = 4096
+
+// DefaultFlushInterval ModeText / ModeBinary で、バッファが BufSize に達していなくてもフラッシュする間隔
+const DefaultFlushInterval = 100 * time.Millisecond
+
+// PipeFrom r から読み込んだバイト列を mode に従ってフレーム化し、ws 宛てに送信し続ける。
+// r が io.EOF を返すと nil を返して終了する。bufSize <= 0 のときは DefaultStreamBufSize を使う。
+// stdout/ログの tail など、長時間動き続ける入力を流し込む用途を想定している。
+func (ws *WebSocket) PipeFrom(r io.Reader, mode Mode, bufSize int) error {
+	if bufSize <= 0 {
+		bufSize = DefaultStreamBufSize
+	}
+	if mode == ModeLines {
+		return ws.pipeLines(r, bufSize)
+	}
+	return ws.pipeChunks(r, mode, bufSize)
+}
+
+func (ws *WebSocket) pipeLines(r io.Reader, bufSize int) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, bufSize), 1<<20)
+	for scanner.Scan() {
+		if err := ws.SendText(scanner.Text()); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// pipeChunks ModeText / ModeBinary 用に、読み取った分を BufSize かフラッシュ間隔
+// どちらか早い方のタイミングでフレームとして送信する
+func (ws *WebSocket) pipeChunks(r io.Reader, mode Mode, bufSize int) error {
+	type chunk struct {
+		data []byte
+		err  error
+	}
+	chunks := make(chan chunk, 1)
+	// done は pipeChunks が送信エラーなどで早期に戻るときに読み取りゴルーチンへ
+	// 中断を伝えるための合図。これがないと、戻った後も r.Read がブロックしたままの
+	// ゴルーチンが、誰も受信しない chunks への送信で永久に残ってしまう
+	done := make(chan struct{})
+	go func() {
+		buf := make([]byte, bufSize)
+		for {
+			n, err := r.Read(buf)
+			if n > 0 {
+				data := make([]byte, n)
+				copy(data, buf[:n])
+				select {
+				case chunks <- chunk{data: data}:
+				case <-done:
+					return
+				}
+			}
+			if err != nil {
+				select {
+				case chunks <- chunk{err: err}:
+				case <-done:
+				}
+				return
+			}
+		}
+	}()
+	defer close(done)
+
+	pending := make([]byte, 0, bufSize)
+	flush := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+		var err error
+		if mode == ModeBinary {
+			err = ws.SendBinary(pending)
+		} else {
+			err = ws.SendText(string(pending))
+		}
+		pending = pending[:0]
+		return err
+	}
+
+	ticker := time.NewTicker(DefaultFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case c := <-chunks:
+			if c.err != nil {
+				if err := flush(); err != nil {
+					return err
+				}
+				if c.err == io.EOF {
+					return nil
+				}
+				return c.err
+			}
+			pending = append(pending, c.data...)
+			if len(pending) >= bufSize {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		case <-ticker.C:
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Sink mode に従って任意の Write をフレーム化し、ws 宛てに送信する io.WriteCloser を返す。
+// BufSize (既定 DefaultStreamBufSize) 分のデータが溜まるか Close されたときに 1 フレームとして送信する。
+func (ws *WebSocket) Sink(mode Mode) io.WriteCloser {
+	return ws.SinkSize(mode, DefaultStreamBufSize)
+}
+
+// SinkSize Sink と同様だが、バッファサイズを指定できる
+func (ws *WebSocket) SinkSize(mode Mode, bufSize int) io.WriteCloser {
+	if bufSize <= 0 {
+		bufSize = DefaultStreamBufSize
+	}
+	return &sinkWriter{ws: ws, mode: mode, bufSize: bufSize}
+}
+
+// sinkWriter Sink / SinkSize が返す io.WriteCloser の実装
+type sinkWriter struct {
+	ws      *WebSocket
+	mode    Mode
+	bufSize int
+	buf     []byte
+	closed  bool
+}
+
+// Write ModeLines のときは改行ごとに、それ以外のときは BufSize 分溜まるごとにフレームを送信する
+func (s *sinkWriter) Write(p []byte) (int, error) {
+	if s.closed {
+		return 0, errors.New("sinkWriter is already closed")
+	}
+	s.buf = append(s.buf, p...)
+	if s.mode == ModeLines {
+		for {
+			i := bytes.IndexByte(s.buf, '\n')
+			if i < 0 {
+				break
+			}
+			line := s.buf[:i]
+			s.buf = s.buf[i+1:]
+			if err := s.ws.SendText(string(line)); err != nil {
+				return 0, err
+			}
+		}
+		return len(p), nil
+	}
+	for len(s.buf) >= s.bufSize {
+		if err := s.flush(s.buf[:s.bufSize]); err != nil {
+			return 0, err
+		}
+		s.buf = s.buf[s.bufSize:]
+	}
+	return len(p), nil
+}
+
+func (s *sinkWriter) flush(data []byte) error {
+	if s.mode == ModeBinary {
+		return s.ws.SendBinary(data)
+	}
+	return s.ws.SendText(string(data))
+}
+
+// Close 溜まっている分を最後のフレームとして送信する
+func (s *sinkWriter) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if len(s.buf) == 0 {
+		return nil
+	}
+	if s.mode == ModeLines {
+		return s.ws.SendText(string(s.buf))
+	}
+	return s.flush(s.buf)
+}
@@ -0,0 +1,119 @@
+package websocket
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// subscribeTexts はテキストフレームを texts へ流し込む Subscribe を別ゴルーチンで開始し、
+// 実際に購読が登録されてから ready を close する。呼び出し側は ready を待ってから
+// 相手にメッセージを送らせることで、登録前に届いたフレームが捨てられる競合を避けられる
+func subscribeTexts(ws *WebSocket) (texts <-chan string, ready <-chan struct{}) {
+	out := make(chan string, 16)
+	r := make(chan struct{})
+	go ws.Subscribe(func(ch <-chan Packet) {
+		close(r)
+		for pkt := range ch {
+			if pkt.Opcode == OpcodeText {
+				out <- string(pkt.Data)
+			}
+		}
+	})
+	return out, r
+}
+
+// collectN は texts から n 件受信するまで待つヘルパー
+func collectN(t *testing.T, texts <-chan string, n int) []string {
+	t.Helper()
+	got := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		select {
+		case s := <-texts:
+			got = append(got, s)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for message %d/%d, got so far: %v", i+1, n, got)
+		}
+	}
+	return got
+}
+
+// TestPipeFromLines は PipeFrom(ModeLines) が入力を改行区切りでテキストフレームとして
+// 送信し、最後に io.EOF で正常終了することを確認する
+func TestPipeFromLines(t *testing.T) {
+	done := make(chan error, 1)
+	clientReady := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(res http.ResponseWriter, req *http.Request) {
+		ws, err := Accept(res, req)
+		if err != nil {
+			return
+		}
+		go func() {
+			<-clientReady
+			done <- ws.PipeFrom(strings.NewReader("line one\nline two\nline three"), ModeLines, 0)
+		}()
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http")
+	client, _, err := Dial(context.Background(), wsURL, nil)
+	if err != nil {
+		t.Fatal("dial failed:", err)
+	}
+	defer client.Close()
+
+	texts, subscribed := subscribeTexts(client)
+	<-subscribed
+	close(clientReady)
+	got := collectN(t, texts, 3)
+	want := []string{"line one", "line two", "line three"}
+	for i, w := range want {
+		if got[i] != w {
+			t.Errorf("line %d: got %q want %q", i, got[i], w)
+		}
+	}
+	if err := <-done; err != nil {
+		t.Error("PipeFrom returned error:", err)
+	}
+}
+
+// TestSink は Sink(ModeText) が BufSize 分溜まるごとと Close 時にフレームを送信することを確認する
+func TestSink(t *testing.T) {
+	clientReady := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(res http.ResponseWriter, req *http.Request) {
+		ws, err := Accept(res, req)
+		if err != nil {
+			return
+		}
+		go func() {
+			<-clientReady
+			sink := ws.SinkSize(ModeText, 4)
+			sink.Write([]byte("abcd")) // ちょうど BufSize なので即座にフラッシュされる
+			sink.Write([]byte("ef"))   // 残り 2 バイトは Close まで溜まる
+			sink.Close()
+		}()
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http")
+	client, _, err := Dial(context.Background(), wsURL, nil)
+	if err != nil {
+		t.Fatal("dial failed:", err)
+	}
+	defer client.Close()
+
+	texts, subscribed := subscribeTexts(client)
+	<-subscribed
+	close(clientReady)
+	got := collectN(t, texts, 2)
+	if got[0] != "abcd" || got[1] != "ef" {
+		t.Errorf("unexpected sink frames: %v", got)
+	}
+}
@@ -2,7 +2,10 @@ package websocket
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"sync"
@@ -15,6 +18,20 @@ type WebSocket struct {
 	subscribes  []chan<- Packet
 	pongCatcher chan<- Packet
 	m           *sync.Mutex
+	writeMu     *sync.Mutex
+	sendMu      *sync.Mutex
+	client      bool
+	pmd         *pmdState
+	protocol    string
+	closeErr    *CloseError
+	closeOnce   sync.Once
+	closeResult error
+}
+
+// Subprotocol ハンドシェイクでネゴシエートされたサブプロトコル名を返す。
+// ネゴシエートされなかったときは空文字列を返す
+func (ws *WebSocket) Subprotocol() string {
+	return ws.protocol
 }
 
 // WebSocket packet 定数
@@ -27,23 +44,75 @@ const (
 	OpcodePong         = 0x8a
 )
 
+// WebSocket close ステータスコード (RFC 6455 7.4.1)
+const (
+	CloseNormal              uint16 = 1000
+	CloseGoingAway           uint16 = 1001
+	CloseProtocolError       uint16 = 1002
+	CloseUnsupportedData     uint16 = 1003
+	CloseInvalidFramePayload uint16 = 1007
+	ClosePolicyViolation     uint16 = 1008
+	CloseMessageTooBig       uint16 = 1009
+	CloseMandatoryExtension  uint16 = 1010
+	CloseInternalError       uint16 = 1011
+)
+
+// CloseError close ハンドシェイクで受け取ったステータスコードと理由
+type CloseError struct {
+	Code   uint16
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket closed: code=%d reason=%q", e.Code, e.Reason)
+}
+
 // Packet WebSocket のパケット
 type Packet struct {
 	Opcode byte
 	Data   []byte
+
+	// rsv1 フレームの RSV1 ビット。permessage-deflate で圧縮されたメッセージの
+	// 先頭フレームかどうかを示す
+	rsv1 bool
 }
 
-func new(c net.Conn) *WebSocket {
+func new(c net.Conn, pmd *pmdState, protocol string) *WebSocket {
 	ws := &WebSocket{
-		c: c,
-		m: &sync.Mutex{},
+		c:        c,
+		m:        &sync.Mutex{},
+		writeMu:  &sync.Mutex{},
+		sendMu:   &sync.Mutex{},
+		pmd:      pmd,
+		protocol: protocol,
 	}
 	go ws.listenPacket()
 	return ws
 }
 
+// newClient はクライアントとして確立した接続から WebSocket を生成する。
+// クライアントが送信するフレームは RFC 6455 の要求どおりマスクされる。
+func newClient(c net.Conn, pmd *pmdState, protocol string) *WebSocket {
+	ws := &WebSocket{
+		c:        c,
+		m:        &sync.Mutex{},
+		writeMu:  &sync.Mutex{},
+		sendMu:   &sync.Mutex{},
+		client:   true,
+		pmd:      pmd,
+		protocol: protocol,
+	}
+	go ws.listenPacket()
+	return ws
+}
+
+// sendPacket はフレームを書き込む。複数の goroutine から同時に呼ばれても
+// フレームのバイト列が混ざらないよう、書き込みは writeMu で直列化する
 func (ws *WebSocket) sendPacket(d *Packet) error {
-	_, err := ws.c.Write(d.packPacket())
+	data := d.packPacket(ws.client)
+	ws.writeMu.Lock()
+	defer ws.writeMu.Unlock()
+	_, err := ws.c.Write(data)
 	return err
 }
 
@@ -70,10 +139,7 @@ func (ws *WebSocket) Subscribe(callback func(<-chan Packet)) {
 
 // SendText 文字列を送信する
 func (ws *WebSocket) SendText(str string) error {
-	return ws.sendPacket(&Packet{
-		Opcode: OpcodeText,
-		Data:   []byte(str),
-	})
+	return ws.sendData(OpcodeText, []byte(str))
 }
 
 // SendBinary バイナリデータを送信する
@@ -81,10 +147,24 @@ func (ws *WebSocket) SendBinary(data []byte) error {
 	if data == nil {
 		data = []byte{}
 	}
-	return ws.sendPacket(&Packet{
-		Opcode: OpcodeBinary,
-		Data:   data,
-	})
+	return ws.sendData(OpcodeBinary, data)
+}
+
+// sendData テキスト/バイナリのメッセージを 1 フレームで送信する。
+// permessage-deflate が有効でペイロードがしきい値以上のときは RSV1 を立てて圧縮する。
+// sendMu で他のデータフレーム (streamWriter が送っている最中の分割メッセージを含む)
+// と排他することで、RFC 6455 5.4 が禁じる「分割メッセージの途中に別のデータフレームが
+// 割り込む」事態を防ぐ
+func (ws *WebSocket) sendData(opcode byte, data []byte) error {
+	ws.sendMu.Lock()
+	defer ws.sendMu.Unlock()
+	if ws.pmd != nil && len(data) >= ws.pmd.opts.minCompressSize() {
+		compressed, err := ws.pmd.compress(data)
+		if err == nil {
+			return ws.sendPacket(&Packet{Opcode: opcode | 0x40, Data: compressed})
+		}
+	}
+	return ws.sendPacket(&Packet{Opcode: opcode, Data: data})
 }
 
 // SendPing ping を送信する
@@ -98,6 +178,84 @@ func (ws *WebSocket) SendPing(data []byte) error {
 	})
 }
 
+// DefaultStreamChunkSize SendStream がチャンクサイズを指定しなかった場合に使用するサイズ
+const DefaultStreamChunkSize = 4096
+
+// SendStream opcode (OpcodeText か OpcodeBinary) のメッセージを複数フレームに
+// 分割して送信する io.WriteCloser を返す。
+// Write を呼ぶたびにチャンクサイズ分のデータが溜まったフレームを送信し、
+// Close を呼んだ時点までに溜まったデータを FIN=1 の最終フレームとして送信する。
+// 呼び出し時点から Close するまで、この WebSocket からの他のデータフレームの送信
+// (SendText/SendBinary や他の SendStream) をブロックする。RFC 6455 5.4 により
+// 分割メッセージの途中に別のデータフレームを割り込ませてはならないため、
+// 必ず速やかに Close すること。
+func (ws *WebSocket) SendStream(opcode byte) io.WriteCloser {
+	return ws.SendStreamSize(opcode, DefaultStreamChunkSize)
+}
+
+// SendStreamSize SendStream と同様だが、チャンクサイズを指定できる
+func (ws *WebSocket) SendStreamSize(opcode byte, chunkSize int) io.WriteCloser {
+	if chunkSize <= 0 {
+		chunkSize = DefaultStreamChunkSize
+	}
+	ws.sendMu.Lock()
+	return &streamWriter{
+		ws:        ws,
+		opcode:    opcode &^ 0x80,
+		chunkSize: chunkSize,
+	}
+}
+
+// streamWriter SendStream が返す io.WriteCloser の実装
+type streamWriter struct {
+	ws        *WebSocket
+	opcode    byte
+	chunkSize int
+	buf       []byte
+	started   bool
+	closed    bool
+}
+
+// Write 書き込まれたデータをチャンクサイズ単位で FIN=0 のフレームとして送信する
+func (w *streamWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("streamWriter is already closed")
+	}
+	w.buf = append(w.buf, p...)
+	for len(w.buf) >= w.chunkSize {
+		if err := w.flush(w.buf[:w.chunkSize], false); err != nil {
+			return 0, err
+		}
+		w.buf = w.buf[w.chunkSize:]
+	}
+	return len(p), nil
+}
+
+// Close 溜まっているデータを FIN=1 の最終フレームとして送信し、ストリームを終了する。
+// SendStreamSize で取得した sendMu をここで解放し、他のデータフレーム送信を再開させる
+func (w *streamWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	defer w.ws.sendMu.Unlock()
+	return w.flush(w.buf, true)
+}
+
+func (w *streamWriter) flush(data []byte, fin bool) error {
+	opcode := byte(OpcodeContinuation & 0x7f)
+	if !w.started {
+		opcode = w.opcode
+	}
+	if fin {
+		opcode |= 0x80
+	}
+	w.started = true
+	buf := make([]byte, len(data))
+	copy(buf, data)
+	return w.ws.sendPacket(&Packet{Opcode: opcode, Data: buf})
+}
+
 // CheckAlive ping を送信し、pong を受け取るまで待機する。
 // t でタイムアウトする時間を設定できる
 func (ws *WebSocket) CheckAlive(t time.Duration) (bool, error) {
@@ -128,27 +286,48 @@ func (ws *WebSocket) CheckAlive(t time.Duration) (bool, error) {
 	}
 }
 
-// Shutdown close パケットを送信し、Websocket を閉じる
+// SendClose RFC 6455 の close ハンドシェイクに従い、ステータスコード (ビッグエンディアン 2 バイト)
+// と理由 (UTF-8) を付けた close パケットを送信する
+func (ws *WebSocket) SendClose(code uint16, reason string) error {
+	data := make([]byte, 2+len(reason))
+	binary.BigEndian.PutUint16(data, code)
+	copy(data[2:], reason)
+	return ws.sendPacket(&Packet{Opcode: OpcodeClose, Data: data})
+}
+
+// Shutdown CloseNormal の close パケットを送信し、Websocket を閉じる
 func (ws *WebSocket) Shutdown() error {
-	ws.sendPacket(&Packet{
-		Opcode: OpcodeClose,
-	})
+	ws.SendClose(CloseNormal, "")
 	return ws.Close()
 }
 
-// Close WebSocket を閉じる
-func (ws *WebSocket) Close() error {
+// CloseError 受信した close ハンドシェイクのステータスコードと理由を返す。
+// 受信していない (相手から close されていない) ときは nil を返す
+func (ws *WebSocket) CloseError() *CloseError {
 	ws.m.Lock()
-	for _, ch := range ws.subscribes {
-		close(ch)
-	}
-	ws.m.Unlock()
-	return ws.c.Close()
+	defer ws.m.Unlock()
+	return ws.closeErr
+}
+
+// Close WebSocket を閉じる。handleClose からの close ハンドシェイク経由の呼び出しと
+// 呼び出し側の defer ws.Close() が競合しうるので、2 回目以降の呼び出しは何もせず、
+// 最初の呼び出しの結果をそのまま返す
+func (ws *WebSocket) Close() error {
+	ws.closeOnce.Do(func() {
+		ws.m.Lock()
+		for _, ch := range ws.subscribes {
+			close(ch)
+		}
+		ws.m.Unlock()
+		ws.closeResult = ws.c.Close()
+	})
+	return ws.closeResult
 }
 
 func (ws *WebSocket) listenPacket() {
 	buf := make([]byte, 1<<20)
 	index := 0
+	var frag fragmentState
 	for {
 		n, err := ws.c.Read(buf[index:])
 		if n > 0 {
@@ -156,36 +335,8 @@ func (ws *WebSocket) listenPacket() {
 			for {
 				packet, remain, err := parsePacket(buf[:index])
 				if packet != nil {
-					switch packet.Opcode {
-					case OpcodeContinuation:
-						// not implemented
-					case OpcodePing:
-						ws.sendPacket(&Packet{
-							Opcode: OpcodePong,
-							Data:   packet.Data,
-						})
-					case OpcodePong:
-						ws.m.Lock()
-						if ws.pongCatcher != nil {
-							ws.m.Unlock()
-							ws.pongCatcher <- *packet
-						} else {
-							ws.m.Unlock()
-						}
-					case OpcodeClose:
-						ws.Close()
+					if !ws.handlePacket(packet, &frag) {
 						return
-					case OpcodeText, OpcodeBinary:
-						// notify subscribers
-						func() {
-							ws.m.Lock()
-							defer ws.m.Unlock()
-							for _, ch := range ws.subscribes {
-								ch <- *packet
-							}
-						}()
-					default:
-						// ignore
 					}
 				}
 				if len(remain) == 0 {
@@ -211,28 +362,150 @@ func (ws *WebSocket) listenPacket() {
 	}
 }
 
-func (pkt *Packet) packPacket() []byte {
+// fragmentState 受信中のフラグメント化されたメッセージの組み立て状態
+type fragmentState struct {
+	active     bool
+	opcode     byte
+	data       []byte
+	compressed bool
+}
+
+// handlePacket 受信した 1 フレーム分のパケットを処理する。
+// 接続を継続する場合は true を、切断した場合は false を返す。
+func (ws *WebSocket) handlePacket(packet *Packet, frag *fragmentState) bool {
+	base := packet.Opcode &^ 0x80
+	fin := packet.Opcode&0x80 != 0
+	switch base {
+	case OpcodeText & 0x7f, OpcodeBinary & 0x7f:
+		if frag.active {
+			// 仕様違反: フラグメント化されたメッセージの途中に
+			// 別のデータフレームが割り込んできた
+			ws.Close()
+			return false
+		}
+		if fin {
+			ws.dispatchMaybeCompressed(packet, packet.rsv1)
+			return true
+		}
+		frag.active = true
+		frag.opcode = base
+		frag.compressed = packet.rsv1
+		frag.data = append([]byte{}, packet.Data...)
+	case OpcodeContinuation & 0x7f:
+		if !frag.active {
+			// 仕様違反: 開始していないメッセージへの継続フレーム
+			ws.Close()
+			return false
+		}
+		frag.data = append(frag.data, packet.Data...)
+		if fin {
+			ws.dispatchMaybeCompressed(&Packet{Opcode: frag.opcode | 0x80, Data: frag.data}, frag.compressed)
+			frag.active = false
+			frag.data = nil
+		}
+	case OpcodePing & 0x7f:
+		ws.sendPacket(&Packet{
+			Opcode: OpcodePong,
+			Data:   packet.Data,
+		})
+	case OpcodePong & 0x7f:
+		ws.m.Lock()
+		if ws.pongCatcher != nil {
+			ws.m.Unlock()
+			ws.pongCatcher <- *packet
+		} else {
+			ws.m.Unlock()
+		}
+	case OpcodeClose & 0x7f:
+		ws.handleClose(packet.Data)
+		return false
+	default:
+		// ignore
+	}
+	return true
+}
+
+// handleClose 相手から届いた close フレームを処理する。
+// RFC 6455 7.1.5 に従い、受け取ったステータスコード・理由をそのまま送り返してから接続を閉じる
+func (ws *WebSocket) handleClose(data []byte) {
+	ce := &CloseError{}
+	if len(data) >= 2 {
+		ce.Code = binary.BigEndian.Uint16(data)
+		ce.Reason = string(data[2:])
+	}
+	ws.m.Lock()
+	ws.closeErr = ce
+	ws.m.Unlock()
+	ws.sendPacket(&Packet{Opcode: OpcodeClose, Data: data})
+	ws.Close()
+}
+
+// dispatchMaybeCompressed compressed が true かつ permessage-deflate が有効なときは
+// パケットを伸張してから購読者に通知する
+func (ws *WebSocket) dispatchMaybeCompressed(packet *Packet, compressed bool) {
+	if compressed && ws.pmd != nil {
+		data, err := ws.pmd.decompress(packet.Data)
+		if err != nil {
+			ws.Close()
+			return
+		}
+		packet.Data = data
+	}
+	ws.dispatch(packet)
+}
+
+// dispatch 完成した 1 つの論理パケットを購読者に通知する
+func (ws *WebSocket) dispatch(packet *Packet) {
+	ws.m.Lock()
+	defer ws.m.Unlock()
+	for _, ch := range ws.subscribes {
+		ch <- *packet
+	}
+}
+
+// packPacket はフレームをバイト列に変換する。
+// masked が true のときはクライアントフレームとしてマスクビットを立て、
+// ランダムな 4 バイトのマスクキーでペイロードを XOR する。
+func (pkt *Packet) packPacket(masked bool) []byte {
 	opcode := pkt.Opcode
 	data := pkt.Data
 	datalen := len(data)
+	maskBit := byte(0)
+	if masked {
+		maskBit = 0x80
+	}
 	var length []byte
 	if datalen < 0x7e {
-		length = []byte{byte(datalen)}
+		length = []byte{maskBit | byte(datalen)}
 	} else if datalen < 0x8000 {
-		length = []byte{0x7e, byte((datalen >> 8) & 0xff), byte(datalen & 0xff)}
+		length = []byte{maskBit | 0x7e, byte((datalen >> 8) & 0xff), byte(datalen & 0xff)}
 	} else {
 		length = []byte{
-			0x7f, 0, 0, 0, 0,
+			maskBit | 0x7f, 0, 0, 0, 0,
 			byte((datalen >> 24) & 0xff),
 			byte((datalen >> 16) & 0xff),
 			byte((datalen >> 8) & 0xff),
 			byte(datalen & 0xff),
 		}
 	}
-	ret := make([]byte, 1+len(length)+len(data))
+	var maskKey []byte
+	if masked {
+		maskKey = make([]byte, 4)
+		rand.Read(maskKey)
+	}
+	ret := make([]byte, 1+len(length)+len(maskKey)+datalen)
 	ret[0] = opcode
 	copy(ret[1:len(length)+1], length)
-	copy(ret[len(length)+1:], data)
+	offset := 1 + len(length)
+	if masked {
+		copy(ret[offset:], maskKey)
+		offset += 4
+		for i := 0; i < datalen; i++ {
+			ret[offset+i] = data[i] ^ maskKey[i&3]
+		}
+	} else {
+		copy(ret[offset:], data)
+	}
 	return ret
 }
 
@@ -240,7 +513,7 @@ func parsePacket(raw []byte) (*Packet, []byte, error) {
 	if len(raw) < 2 {
 		return nil, raw, errors.New("too short bytes")
 	}
-	ret := &Packet{Opcode: raw[0]}
+	ret := &Packet{Opcode: raw[0] &^ 0x70, rsv1: raw[0]&0x40 != 0}
 	masked := raw[1]&0x80 == 0x80
 	lengthHeader := raw[1] & 0x7f
 	length := 0
@@ -282,7 +555,12 @@ func parsePacket(raw []byte) (*Packet, []byte, error) {
 		if len(data) < length {
 			return nil, raw, errors.New("length is longer")
 		}
-		ret.Data = data[:length]
+		// data[:length] は listenPacket の使い回しバッファ buf を指しているため、
+		// そのまま Packet.Data として渡すと、次のフレームの読み込みで上書きされる前に
+		// 購読者がコピーし終える保証がない。ここでコピーしておく
+		buf := make([]byte, length)
+		copy(buf, data[:length])
+		ret.Data = buf
 	}
 	remain := data[length:]
 	return ret, remain, nil
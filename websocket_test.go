@@ -3,6 +3,7 @@ package websocket
 import (
 	"bytes"
 	"crypto/rand"
+	"errors"
 	"log"
 	"net"
 	"net/http"
@@ -83,7 +84,7 @@ func TestWebSocket(t *testing.T) {
 		t.Error("dial failed:", err)
 		return
 	}
-	request := "GET / HTTP/1.1\r\nHost: localhost:12345\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n"
+	request := "GET / HTTP/1.1\r\nHost: localhost:12345\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n"
 	if _, err := conn.Write([]byte(request)); err != nil {
 		t.Error("failed to send to server:", err)
 		return
@@ -200,3 +201,86 @@ func TestWebSocket(t *testing.T) {
 		t.Error("close not work")
 	}
 }
+
+// TestFragmentedMessage は、テキストメッセージを複数の継続フレームに分割して
+// 送受信したときに、受信側で正しく 1 つのメッセージへ組み立てられることを確認する
+func TestFragmentedMessage(t *testing.T) {
+	lsn, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal("listen failed:", err)
+	}
+	h := newHandler()
+	go http.Serve(lsn, h)
+	defer lsn.Close()
+
+	conn, err := net.Dial("tcp", lsn.Addr().String())
+	if err != nil {
+		t.Fatal("dial failed:", err)
+	}
+	defer conn.Close()
+	if err := handshake(conn, lsn.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	mask := make([]byte, 4)
+	rand.Read(mask)
+	xor := func(data []byte) []byte {
+		out := make([]byte, len(data))
+		for i := range data {
+			out[i] = data[i] ^ mask[i%4]
+		}
+		return out
+	}
+	frames := [][]byte{
+		append([]byte{OpcodeText & 0x7f, 0x80 | 3}, append(mask, xor([]byte("abc"))...)...),
+		append([]byte{OpcodeContinuation & 0x7f, 0x80 | 3}, append(mask, xor([]byte("def"))...)...),
+		append([]byte{byte(OpcodeContinuation&0x7f) | 0x80, 0x80 | 3}, append(mask, xor([]byte("ghi"))...)...),
+	}
+	for _, frame := range frames {
+		if _, err := conn.Write(frame); err != nil {
+			t.Fatal("failed to send fragment:", err)
+		}
+	}
+	<-h.receiveCh
+	if len(h.texts) != 1 || h.texts[0] != "abcdefghi" {
+		t.Error("fragmented message not reassembled correctly:", h.texts)
+	}
+
+	// SendStream 側 (サーバーからクライアントへの分割送信) も確認する
+	w := h.ws.SendStreamSize(OpcodeText, 3)
+	w.Write([]byte("abcdef"))
+	w.Close()
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal("failed to receive stream:", err)
+	}
+	got, _, _ := parsePacket(buf[:n])
+	if got == nil {
+		t.Fatal("failed to parse first stream frame:", buf[:n])
+	}
+	if got.Opcode&0x80 != 0 {
+		t.Error("first stream frame should not be FIN:", buf[:n])
+	}
+	if string(got.Data) != "abc" {
+		t.Errorf("unexpected first stream frame: %q", got.Data)
+	}
+}
+
+// handshake は net.Dial した生の接続で RFC 6455 のハンドシェイクを行う簡易ヘルパー
+func handshake(conn net.Conn, addr string) error {
+	request := "GET / HTTP/1.1\r\nHost: " + addr + "\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n"
+	if _, err := conn.Write([]byte(request)); err != nil {
+		return err
+	}
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(string(buf[:n]), "101 Switching Protocols") {
+		return errors.New("handshake failed: " + string(buf[:n]))
+	}
+	return nil
+}